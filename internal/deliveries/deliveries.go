@@ -0,0 +1,183 @@
+// Package deliveries tracks what happens to outbound mail after the
+// SMTP handoff — sent, bounced, or complained — keyed by a token
+// generated at send time and embedded in both the Message-Id header and
+// a per-send bounce address, so an inbound DSN/ARF report can be routed
+// back to the right row. Hard bounces feed a suppression list so future
+// sends to a dead address are skipped instead of repeated.
+package deliveries
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	supabase "github.com/lengzuo/supa"
+)
+
+// Status is the lifecycle of one outbound message as tracked after the
+// SMTP handoff.
+type Status string
+
+const (
+	StatusSent       Status = "sent"
+	StatusBounced    Status = "bounced"
+	StatusComplained Status = "complained"
+)
+
+// Delivery is one row of the email_deliveries table.
+type Delivery struct {
+	MessageID      string    `json:"message_id"`
+	UserID         string    `json:"user_id"`
+	ServiceID      string    `json:"service_id"`
+	TemplateID     string    `json:"template_id"`
+	RecipientEmail string    `json:"recipient_email"`
+	Status         Status    `json:"status,omitempty"`
+	DiagnosticCode string    `json:"diagnostic_code,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+}
+
+// Tracker records deliveries and maintains the suppression list.
+type Tracker struct {
+	db *supabase.Client
+}
+
+// New returns a Tracker backed by db.
+func New(db *supabase.Client) *Tracker {
+	return &Tracker{db: db}
+}
+
+// NewMessageID returns a random token used both as the email_deliveries
+// primary key and as the local-part payload of a bounce address.
+func NewMessageID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// BounceAddress builds the per-send envelope address an inbound
+// listener can parse back into (serviceID, messageID): everything a DSN
+// or ARF report needs to find its way to the right delivery row.
+func BounceAddress(bounceDomain, serviceID, messageID string) string {
+	return fmt.Sprintf("bounce+%s+%s@%s", serviceID, messageID, bounceDomain)
+}
+
+// ParseBounceAddress reverses BounceAddress.
+func ParseBounceAddress(address string) (serviceID, messageID string, ok bool) {
+	local, _, found := strings.Cut(address, "@")
+	if !found || !strings.HasPrefix(local, "bounce+") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(local, "bounce+"), "+", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Record inserts the email_deliveries row created once a message has
+// actually been handed off to a mail server, so the inbound listener
+// has something to update when a bounce or complaint arrives later.
+func (t *Tracker) Record(ctx context.Context, d Delivery) error {
+	d.Status = StatusSent
+	if err := t.db.DB.From("email_deliveries").Insert(d).Execute(ctx, nil); err != nil {
+		return fmt.Errorf("failed to record delivery: %v", err)
+	}
+	return nil
+}
+
+// Get fetches one delivery by its Message-ID token. Used internally by
+// UpdateStatus, which runs off an inbound DSN/ARF report and has no
+// user_key to scope by; GetForUser is what HTTP handlers should use.
+func (t *Tracker) Get(ctx context.Context, messageID string) (*Delivery, error) {
+	var rows []Delivery
+	err := t.db.DB.From("email_deliveries").
+		Select("*").
+		Eq("message_id", messageID).
+		Execute(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch delivery: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no delivery found for message_id: %s", messageID)
+	}
+	return &rows[0], nil
+}
+
+// GetForUser fetches one delivery by its Message-ID token, scoped to
+// userID, for GET /deliveries/{message_id} so one user can't read
+// another's delivery status by guessing its id.
+func (t *Tracker) GetForUser(ctx context.Context, messageID, userID string) (*Delivery, error) {
+	var rows []Delivery
+	err := t.db.DB.From("email_deliveries").
+		Select("*").
+		Eq("message_id", messageID).
+		Eq("user_id", userID).
+		Execute(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch delivery: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no delivery found for message_id: %s", messageID)
+	}
+	return &rows[0], nil
+}
+
+// UpdateStatus applies a bounce/complaint report to the delivery row
+// identified by messageID. A hard bounce also suppresses the
+// recipient, so future sends stop retrying a dead address.
+func (t *Tracker) UpdateStatus(ctx context.Context, messageID string, status Status, diagnosticCode string, hardBounce bool) error {
+	delivery, err := t.Get(ctx, messageID)
+	if err != nil {
+		return err
+	}
+
+	err = t.db.DB.From("email_deliveries").
+		Update(map[string]interface{}{
+			"status":          string(status),
+			"diagnostic_code": diagnosticCode,
+		}).
+		Eq("message_id", messageID).
+		Execute(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to update delivery: %v", err)
+	}
+
+	if hardBounce {
+		return t.Suppress(ctx, delivery.UserID, delivery.RecipientEmail, "hard bounce")
+	}
+	return nil
+}
+
+// Suppress adds an address to userID's suppression list.
+func (t *Tracker) Suppress(ctx context.Context, userID, email, reason string) error {
+	err := t.db.DB.From("suppressions").Insert(map[string]interface{}{
+		"user_id":       userID,
+		"email_address": email,
+		"reason":        reason,
+	}).Execute(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to record suppression: %v", err)
+	}
+	return nil
+}
+
+// IsSuppressed reports whether email is on userID's suppression list.
+func (t *Tracker) IsSuppressed(ctx context.Context, userID, email string) (bool, error) {
+	var rows []struct {
+		EmailAddress string `json:"email_address"`
+	}
+	err := t.db.DB.From("suppressions").
+		Select("email_address").
+		Eq("user_id", userID).
+		Eq("email_address", email).
+		Execute(ctx, &rows)
+	if err != nil {
+		return false, fmt.Errorf("failed to check suppression list: %v", err)
+	}
+	return len(rows) > 0, nil
+}
@@ -0,0 +1,152 @@
+// Package inbound runs a minimal SMTP server that receives the
+// asynchronous bounce/complaint feedback a real send can't see at
+// handoff time: DSNs (RFC 3464, multipart/report + message/delivery-status)
+// and ARF spam complaints (RFC 5965, multipart/report +
+// message/feedback-report), both addressed to the per-send
+// bounce+<service_id>+<message_id>@<bounce domain> address generated by
+// deliveries.BounceAddress.
+package inbound
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"nextinbox/internal/deliveries"
+)
+
+// Server accepts inbound bounce/complaint reports on a configurable
+// address and feeds the result into a deliveries.Tracker.
+type Server struct {
+	smtpServer *smtp.Server
+}
+
+// New returns a Server that will listen on addr (e.g. ":2525").
+func New(addr string, tracker *deliveries.Tracker) *Server {
+	s := smtp.NewServer(&backend{tracker: tracker})
+	s.Addr = addr
+	s.Domain = "bounces.example.com"
+	s.AllowInsecureAuth = true
+	return &Server{smtpServer: s}
+}
+
+// ListenAndServe blocks accepting inbound mail until the listener fails.
+func (s *Server) ListenAndServe() error {
+	return s.smtpServer.ListenAndServe()
+}
+
+type backend struct {
+	tracker *deliveries.Tracker
+}
+
+func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{tracker: b.tracker}, nil
+}
+
+// session handles one inbound SMTP transaction. Senders here are other
+// mail servers reporting a bounce/complaint, not our own users, so
+// there's no AUTH or rate limiting to apply.
+type session struct {
+	tracker *deliveries.Tracker
+	rcptTo  string
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.rcptTo = to
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	_, messageID, ok := deliveries.ParseBounceAddress(s.rcptTo)
+	if !ok {
+		return fmt.Errorf("not a recognized bounce address: %s", s.rcptTo)
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read report: %v", err)
+	}
+
+	status, diagnosticCode, hardBounce, err := parseReport(raw)
+	if err != nil {
+		// A report we can't parse shouldn't fail the SMTP transaction
+		// (the sending MTA would just keep retrying it); log and move on.
+		log.Printf("inbound: failed to parse report for message %s: %v", messageID, err)
+		return nil
+	}
+
+	if err := s.tracker.UpdateStatus(context.Background(), messageID, status, diagnosticCode, hardBounce); err != nil {
+		log.Printf("inbound: failed to record delivery update for message %s: %v", messageID, err)
+	}
+	return nil
+}
+
+func (s *session) Reset()        { s.rcptTo = "" }
+func (s *session) Logout() error { return nil }
+
+// parseReport extracts the outcome from a multipart/report message: a
+// message/delivery-status part (DSN bounce) or a message/feedback-report
+// part (ARF spam complaint).
+func parseReport(raw []byte) (status deliveries.Status, diagnosticCode string, hardBounce bool, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to parse message: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/report") {
+		return "", "", false, fmt.Errorf("not a multipart/report message")
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", false, fmt.Errorf("failed to read report part: %v", err)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status":
+			body, _ := io.ReadAll(part)
+			code, permanent := parseDeliveryStatus(body)
+			return deliveries.StatusBounced, code, permanent, nil
+		case "message/feedback-report":
+			// An abuse complaint is always treated like a hard bounce:
+			// the recipient doesn't want this mail, full stop.
+			return deliveries.StatusComplained, "abuse complaint", true, nil
+		}
+	}
+
+	return "", "", false, fmt.Errorf("no recognized report part found")
+}
+
+// parseDeliveryStatus reads the "Status:" field of an RFC 3464
+// message/delivery-status part and reports whether its class digit
+// marks a permanent (5.x.x) rather than transient (4.x.x) failure.
+func parseDeliveryStatus(body []byte) (statusCode string, permanent bool) {
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToLower(line), "status:") {
+			continue
+		}
+		statusCode = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		return statusCode, strings.HasPrefix(statusCode, "5.")
+	}
+	return "", false
+}
@@ -0,0 +1,66 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimSignedHeaders lists the headers that get a DKIM signature, with
+// "From" oversigned - listed more times than it actually occurs - to
+// stop an attacker adding a second From header after the message is
+// signed; per go-msgauth/dkim's HeaderKeys doc, a header named more
+// times than it's present still validates only the existing occurrence
+// but invalidates the signature if another one is later added.
+var dkimSignedHeaders = []string{"From", "From", "To", "Subject", "Date", "Message-Id", "MIME-Version", "Content-Type"}
+
+// signDKIM signs raw with relaxed/relaxed canonicalization and returns
+// the message with the DKIM-Signature header prepended.
+func signDKIM(raw []byte, domain, selector, privateKeyPEM string) ([]byte, error) {
+	signer, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dkim private key: %v", err)
+	}
+
+	options := &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimSignedHeaders,
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(raw), options); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
+
+// parsePrivateKey accepts either a PKCS#1 or PKCS#8 PEM-encoded key, as
+// a dkim_private_key_pem column could reasonably hold either.
+func parsePrivateKey(pemStr string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(pemStr))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key encoding: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key does not support signing")
+	}
+	return signer, nil
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeSender is an in-memory Provider that records every message handed
+// to it instead of contacting a real mail server. Wire it into a
+// MailService via main.WithSMTPSender so tests can exercise the full
+// render-and-send pipeline without a live SMTP server.
+type FakeSender struct {
+	mu   sync.Mutex
+	sent []Message
+
+	// SendFunc, if set, runs after the message is recorded and its
+	// return value becomes Send's return value — useful for simulating
+	// a transient or permanent delivery failure.
+	SendFunc func(ctx context.Context, msg Message) error
+}
+
+// Send records msg and, if SendFunc is set, delegates to it.
+func (f *FakeSender) Send(ctx context.Context, msg Message) error {
+	f.mu.Lock()
+	f.sent = append(f.sent, msg)
+	f.mu.Unlock()
+
+	if f.SendFunc != nil {
+		return f.SendFunc(ctx, msg)
+	}
+	return nil
+}
+
+// Calls returns the messages recorded so far, in send order.
+func (f *FakeSender) Calls() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Message, len(f.sent))
+	copy(out, f.sent)
+	return out
+}
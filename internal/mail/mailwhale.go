@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func init() {
+	Register("mailwhale", newMailWhaleProvider)
+}
+
+// mailWhaleConfig is the shape of a service's provider_config blob when
+// provider = "mailwhale".
+type mailWhaleConfig struct {
+	BaseURL string `json:"base_url"`
+	APIKey  string `json:"api_key"`
+}
+
+// mailWhaleProvider submits the already-assembled raw message to a
+// self-hosted MailWhale instance's send API.
+type mailWhaleProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func newMailWhaleProvider(cfg Config) (Provider, error) {
+	var mwCfg mailWhaleConfig
+	if err := json.Unmarshal(cfg.ProviderConfig, &mwCfg); err != nil {
+		return nil, fmt.Errorf("invalid mailwhale provider_config: %v", err)
+	}
+	if mwCfg.BaseURL == "" || mwCfg.APIKey == "" {
+		return nil, fmt.Errorf("mailwhale provider requires base_url and api_key")
+	}
+	return &mailWhaleProvider{baseURL: mwCfg.BaseURL, apiKey: mwCfg.APIKey, client: http.DefaultClient}, nil
+}
+
+func (p *mailWhaleProvider) Send(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"from": msg.From,
+		"to":   msg.To,
+		"cc":   msg.Cc,
+		"bcc":  msg.Bcc,
+		"raw":  string(msg.Raw),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal mailwhale payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/mails", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build mailwhale request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("api", p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("mailwhale request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("mailwhale returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package mail abstracts outbound email delivery behind a single
+// Provider interface so a Service row can be backed by plain SMTP or by
+// an HTTP-based transactional mail API without the caller needing to
+// care which one it is.
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"nextinbox/internal/mailbuilder"
+)
+
+// Message is the provider-agnostic representation of an email that is
+// ready to send. Raw is the fully assembled RFC 5322 message (headers +
+// body) and is what providers that accept raw MIME (smtp, mailwhale,
+// ses) hand off as-is. Subject/HTML/PlainText/Attachments are populated
+// alongside Raw for providers whose APIs expect structured fields
+// instead of a raw MIME blob (sendgrid).
+type Message struct {
+	From        string
+	To          string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	HTML        string
+	PlainText   string
+	Attachments []mailbuilder.Attachment
+	Raw         []byte
+
+	// EnvelopeFrom, if set, is used as the SMTP envelope sender (MAIL
+	// FROM) instead of From - e.g. a per-send bounce address so DSN/ARF
+	// feedback can be routed back to the message that caused it. Only
+	// the smtp provider honors it; HTTP-based providers have no
+	// envelope-level control to set it on.
+	EnvelopeFrom string
+}
+
+// Provider sends a single Message through a specific mail backend.
+type Provider interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Config carries everything a Factory needs to build a Provider for a
+// service. HostAddress/Port/EmailID/Password come from the service's
+// own columns and are used directly by the smtp provider; ProviderConfig
+// is the service's provider-specific JSON blob, consumed by the
+// HTTP-based providers.
+type Config struct {
+	HostAddress    string
+	Port           int
+	EmailID        string
+	Password       string
+	ProviderConfig json.RawMessage
+
+	// TLS/DKIM options, consumed by the smtp provider only.
+	TLSMode           string // "starttls" (default), "implicit", "plain"
+	TLSSkipVerify     bool
+	DKIMSelector      string
+	DKIMPrivateKeyPEM string
+}
+
+// Factory builds a Provider from a service's Config.
+type Factory func(cfg Config) (Provider, error)
+
+var registry = map[string]Factory{}
+
+// Register adds a provider constructor under name. Each provider calls
+// this from its own init() so New can look it up by the Service's
+// `provider` column.
+func Register(name string, factory Factory) {
+	registry[name] = factory
+}
+
+// New builds the provider registered under name.
+func New(name string, cfg Config) (Provider, error) {
+	if name == "" {
+		name = "smtp"
+	}
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown mail provider: %s", name)
+	}
+	return factory(cfg)
+}
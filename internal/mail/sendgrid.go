@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nextinbox/internal/mailbuilder"
+)
+
+func init() {
+	Register("sendgrid", newSendGridProvider)
+}
+
+// sendGridConfig is the shape of a service's provider_config blob when
+// provider = "sendgrid".
+type sendGridConfig struct {
+	APIKey string `json:"api_key"`
+}
+
+// sendGridProvider calls the SendGrid v3 /mail/send API directly over
+// net/http rather than pulling in the full sendgrid-go SDK.
+type sendGridProvider struct {
+	apiKey string
+	client *http.Client
+}
+
+func newSendGridProvider(cfg Config) (Provider, error) {
+	var sgCfg sendGridConfig
+	if err := json.Unmarshal(cfg.ProviderConfig, &sgCfg); err != nil {
+		return nil, fmt.Errorf("invalid sendgrid provider_config: %v", err)
+	}
+	if sgCfg.APIKey == "" {
+		return nil, fmt.Errorf("sendgrid provider requires api_key")
+	}
+	return &sendGridProvider{apiKey: sgCfg.APIKey, client: http.DefaultClient}, nil
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+func (p *sendGridProvider) Send(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(sendGridRequest{
+		Personalizations: []sendGridPersonalization{{
+			To:  []sendGridAddress{{Email: msg.To}},
+			Cc:  addressList(msg.Cc),
+			Bcc: addressList(msg.Bcc),
+		}},
+		From:        sendGridAddress{Email: msg.From},
+		Subject:     msg.Subject,
+		Content:     sendGridContents(msg),
+		Attachments: sendGridAttachments(msg.Attachments),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal sendgrid payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build sendgrid request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sendgrid request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendGridContents builds the content array for msg. SendGrid requires
+// text/plain to precede text/html when both are present.
+func sendGridContents(msg Message) []sendGridContent {
+	contents := make([]sendGridContent, 0, 2)
+	if msg.PlainText != "" {
+		contents = append(contents, sendGridContent{Type: "text/plain", Value: msg.PlainText})
+	}
+	return append(contents, sendGridContent{Type: "text/html", Value: msg.HTML})
+}
+
+func sendGridAttachments(attachments []mailbuilder.Attachment) []sendGridAttachment {
+	if len(attachments) == 0 {
+		return nil
+	}
+	out := make([]sendGridAttachment, 0, len(attachments))
+	for _, a := range attachments {
+		disposition := "attachment"
+		if a.Inline {
+			disposition = "inline"
+		}
+		out = append(out, sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			Type:        a.ContentType,
+			Filename:    a.Filename,
+			Disposition: disposition,
+			ContentID:   a.ContentID,
+		})
+	}
+	return out
+}
+
+func addressList(emails []string) []sendGridAddress {
+	if len(emails) == 0 {
+		return nil
+	}
+	addresses := make([]sendGridAddress, 0, len(emails))
+	for _, email := range emails {
+		addresses = append(addresses, sendGridAddress{Email: email})
+	}
+	return addresses
+}
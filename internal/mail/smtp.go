@@ -0,0 +1,167 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+func init() {
+	Register("smtp", newSMTPProvider)
+}
+
+// TLSMode controls how the smtp provider establishes transport
+// security when connecting to a service's mail server.
+type TLSMode string
+
+const (
+	TLSModeSTARTTLS TLSMode = "starttls" // plain connect, then STARTTLS (default)
+	TLSModeImplicit TLSMode = "implicit" // TLS from the first byte, e.g. SUBMISSIONS on 465
+	TLSModePlain    TLSMode = "plain"    // no TLS at all
+)
+
+// smtpProvider sends mail over go-smtp instead of net/smtp so the
+// TLS mode and DKIM signing can be controlled per service.
+type smtpProvider struct {
+	host          string
+	port          int
+	email         string
+	password      string
+	tlsMode       TLSMode
+	tlsSkipVerify bool
+
+	dkimDomain     string
+	dkimSelector   string
+	dkimPrivateKey string
+}
+
+func newSMTPProvider(cfg Config) (Provider, error) {
+	if cfg.HostAddress == "" || cfg.Port == 0 {
+		return nil, fmt.Errorf("smtp provider requires host_address and port")
+	}
+
+	tlsMode := TLSMode(cfg.TLSMode)
+	if tlsMode == "" {
+		tlsMode = TLSModeSTARTTLS
+	}
+
+	return &smtpProvider{
+		host:           cfg.HostAddress,
+		port:           cfg.Port,
+		email:          cfg.EmailID,
+		password:       cfg.Password,
+		tlsMode:        tlsMode,
+		tlsSkipVerify:  cfg.TLSSkipVerify,
+		dkimDomain:     domainOf(cfg.EmailID),
+		dkimSelector:   cfg.DKIMSelector,
+		dkimPrivateKey: cfg.DKIMPrivateKeyPEM,
+	}, nil
+}
+
+func (p *smtpProvider) Send(ctx context.Context, msg Message) error {
+	raw := msg.Raw
+	if p.dkimSelector != "" && p.dkimPrivateKey != "" {
+		signed, err := signDKIM(raw, p.dkimDomain, p.dkimSelector, p.dkimPrivateKey)
+		if err != nil {
+			return fmt.Errorf("dkim signing failed: %v", err)
+		}
+		raw = signed
+	}
+
+	client, err := dialSMTP(p.host, p.port, p.tlsMode, p.tlsSkipVerify)
+	if err != nil {
+		return fmt.Errorf("smtp dial failed: %w", err)
+	}
+	defer client.Close()
+
+	if p.email != "" && p.password != "" {
+		if err := client.Auth(sasl.NewPlainClient("", p.email, p.password)); err != nil {
+			return fmt.Errorf("smtp auth failed: %w", err)
+		}
+	}
+
+	envelope := append([]string{msg.To}, msg.Cc...)
+	envelope = append(envelope, msg.Bcc...)
+
+	envelopeFrom := msg.From
+	if msg.EnvelopeFrom != "" {
+		envelopeFrom = msg.EnvelopeFrom
+	}
+
+	return client.SendMail(envelopeFrom, envelope, bytes.NewReader(raw))
+}
+
+// dialSMTP connects to host:port according to mode: implicit TLS from
+// the first byte (SUBMISSIONS/465), STARTTLS negotiated on a plain
+// connection (the common 587 case), or no TLS at all.
+func dialSMTP(host string, port int, mode TLSMode, skipVerify bool) (*smtp.Client, error) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: skipVerify}
+
+	switch mode {
+	case TLSModeImplicit:
+		return smtp.DialTLS(addr, tlsConfig)
+	case TLSModePlain:
+		return smtp.Dial(addr)
+	default: // TLSModeSTARTTLS
+		return smtp.DialStartTLS(addr, tlsConfig)
+	}
+}
+
+// VerifyResult reports what an SMTP server negotiated during
+// POST /services/{id}/verify, so a user can debug a misconfigured
+// host/port/TLS combination without sending a real email.
+type VerifyResult struct {
+	STARTTLSSupported bool     `json:"starttls_supported"`
+	AuthMechanisms    []string `json:"auth_mechanisms"`
+	AuthSucceeded     bool     `json:"auth_succeeded"`
+}
+
+// VerifySMTP opens a connection, negotiates TLS per cfg.TLSMode, and
+// reports the server's STARTTLS/AUTH capabilities, attempting to
+// authenticate if credentials are present.
+func VerifySMTP(cfg Config) (*VerifyResult, error) {
+	tlsMode := TLSMode(cfg.TLSMode)
+	if tlsMode == "" {
+		tlsMode = TLSModeSTARTTLS
+	}
+
+	client, err := dialSMTP(cfg.HostAddress, cfg.Port, tlsMode, cfg.TLSSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	result := &VerifyResult{}
+	result.STARTTLSSupported, _ = client.Extension("STARTTLS")
+	if tlsMode == TLSModeSTARTTLS {
+		// The connection was already upgraded by STARTTLS, and a server
+		// doesn't advertise STARTTLS again in the post-upgrade EHLO.
+		result.STARTTLSSupported = true
+	}
+
+	if ok, authParam := client.Extension("AUTH"); ok {
+		result.AuthMechanisms = strings.Fields(authParam)
+	}
+
+	if cfg.EmailID != "" && cfg.Password != "" {
+		if err := client.Auth(sasl.NewPlainClient("", cfg.EmailID, cfg.Password)); err != nil {
+			return result, fmt.Errorf("authentication failed: %v", err)
+		}
+		result.AuthSucceeded = true
+	}
+
+	return result, nil
+}
+
+func domainOf(email string) string {
+	if i := strings.LastIndex(email, "@"); i != -1 {
+		return email[i+1:]
+	}
+	return email
+}
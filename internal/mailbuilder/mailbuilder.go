@@ -0,0 +1,216 @@
+// Package mailbuilder assembles a proper RFC 5322 message tree
+// (multipart/mixed -> multipart/alternative -> text/plain + text/html,
+// with inline images and attachments) instead of the single
+// text/html-only body the service used to hand SMTP directly.
+package mailbuilder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	emmail "github.com/emersion/go-message/mail"
+)
+
+// Attachment is a file to embed in the built message, either as a
+// regular attachment or, when Inline is true, as an inline image
+// referenced from the HTML body via "cid:<ContentID>".
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+	Inline      bool
+	ContentID   string
+}
+
+// Params describes everything needed to assemble one message.
+type Params struct {
+	From        string
+	To          string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	HTML        string
+	PlainText   string // if empty, derived from HTML via StripHTML
+	Attachments []Attachment
+
+	// MessageID, if set, becomes the Message-Id header (without angle
+	// brackets, e.g. "abc123@example.com") so a later bounce/complaint
+	// report can be matched back to this send.
+	MessageID string
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// StripHTML is the fallback used when a template has no explicit
+// plain-text variant: strip tags so there's still a readable plain
+// part for clients and spam filters that expect multipart/alternative.
+func StripHTML(html string) string {
+	return strings.TrimSpace(tagPattern.ReplaceAllString(html, ""))
+}
+
+// Build assembles the full RFC 5322 message and returns its raw bytes.
+//
+// emmail's high-level Writer only exposes multipart/mixed at the top
+// and multipart/alternative for the inline text body - it has no way
+// to nest a multipart/related part between them for inline images, so
+// the body and attachments are written with the lower-level message
+// package directly instead; emmail.Header is still used to build the
+// top-level address/subject/date headers since it already knows how
+// to format those correctly.
+func Build(p Params) ([]byte, error) {
+	var h emmail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*emmail.Address{{Address: p.From}})
+	h.SetAddressList("To", []*emmail.Address{{Address: p.To}})
+	if len(p.Cc) > 0 {
+		h.SetAddressList("Cc", toAddressList(p.Cc))
+	}
+	h.SetSubject(p.Subject)
+	if p.MessageID != "" {
+		h.Set("Message-Id", "<"+p.MessageID+">")
+	}
+	h.Set("Content-Type", "multipart/mixed")
+
+	var buf bytes.Buffer
+	mw, err := message.CreateWriter(&buf, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mime writer: %v", err)
+	}
+
+	if err := writeBody(mw, p); err != nil {
+		return nil, err
+	}
+
+	for _, att := range p.Attachments {
+		if att.Inline {
+			continue // already written as part of the related body above
+		}
+		if err := writeAttachment(mw, att); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close mime writer: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBody writes the multipart/alternative text/plain + text/html
+// tree as the message's inline part. If there are inline images, the
+// alternative part is wrapped in multipart/related with the images as
+// its siblings instead of cramming them into the alternative itself -
+// per RFC 2046, multipart/alternative means "render exactly one
+// equivalent part", and a client that picks the last part it
+// understands would render a lone inline image in place of the HTML
+// body it's meant to decorate.
+func writeBody(mw *message.Writer, p Params) error {
+	var inlineAtts []Attachment
+	for _, att := range p.Attachments {
+		if att.Inline {
+			inlineAtts = append(inlineAtts, att)
+		}
+	}
+
+	bodyWriter := mw
+	if len(inlineAtts) > 0 {
+		var rh message.Header
+		rh.Set("Content-Type", "multipart/related")
+		rw, err := mw.CreatePart(rh)
+		if err != nil {
+			return fmt.Errorf("failed to create related part: %v", err)
+		}
+		defer rw.Close()
+		bodyWriter = rw
+	}
+
+	var ah message.Header
+	ah.Set("Content-Type", "multipart/alternative")
+	aw, err := bodyWriter.CreatePart(ah)
+	if err != nil {
+		return fmt.Errorf("failed to create alternative part: %v", err)
+	}
+
+	plainText := p.PlainText
+	if plainText == "" {
+		plainText = StripHTML(p.HTML)
+	}
+	if err := writeTextPart(aw, "text/plain; charset=utf-8", plainText); err != nil {
+		return err
+	}
+	if err := writeTextPart(aw, "text/html; charset=utf-8", p.HTML); err != nil {
+		return err
+	}
+	// Close the alternative part before any inline image is written, so
+	// its closing boundary precedes the images rather than following them.
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to close alternative part: %v", err)
+	}
+
+	for _, att := range inlineAtts {
+		if err := writeInlinePart(bodyWriter, att); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTextPart(mw *message.Writer, contentType, body string) error {
+	var h message.Header
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return fmt.Errorf("failed to write %s part: %v", contentType, err)
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		return fmt.Errorf("failed to write %s body: %v", contentType, err)
+	}
+	return w.Close()
+}
+
+func writeInlinePart(mw *message.Writer, att Attachment) error {
+	var h message.Header
+	h.Set("Content-Type", att.ContentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-ID", fmt.Sprintf("<%s>", att.ContentID))
+	h.Set("Content-Disposition", "inline; filename=\""+att.Filename+"\"")
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return fmt.Errorf("failed to write inline image %s: %v", att.Filename, err)
+	}
+	if _, err := w.Write(att.Content); err != nil {
+		return fmt.Errorf("failed to write inline image body %s: %v", att.Filename, err)
+	}
+	return w.Close()
+}
+
+func writeAttachment(mw *message.Writer, att Attachment) error {
+	var h message.Header
+	h.Set("Content-Type", att.ContentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.SetContentDisposition("attachment", map[string]string{"filename": att.Filename})
+
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return fmt.Errorf("failed to write attachment %s: %v", att.Filename, err)
+	}
+	if _, err := w.Write(att.Content); err != nil {
+		return fmt.Errorf("failed to write attachment body %s: %v", att.Filename, err)
+	}
+	return w.Close()
+}
+
+func toAddressList(emails []string) []*emmail.Address {
+	addresses := make([]*emmail.Address, 0, len(emails))
+	for _, email := range emails {
+		addresses = append(addresses, &emmail.Address{Address: email})
+	}
+	return addresses
+}
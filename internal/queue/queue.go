@@ -0,0 +1,125 @@
+// Package queue is the persistent async send queue backing
+// /send-emails: every recipient becomes a row in the `email_jobs`
+// table so a send survives a process restart, and a worker pool drains
+// it with exponential-backoff retry instead of the handler sending
+// synchronously on the request goroutine.
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	supabase "github.com/lengzuo/supa"
+)
+
+// Status is the lifecycle state of a queued email job.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusInFlight  Status = "in_flight"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// MaxAttempts bounds how many times a job is attempted in total before
+// it is marked permanently failed.
+const MaxAttempts = 5
+
+// Job is a row in the email_jobs table: one recipient within a batch.
+type Job struct {
+	JobID          string          `json:"job_id,omitempty"`
+	BatchID        string          `json:"batch_id"`
+	UserID         string          `json:"user_id"`
+	ServiceID      string          `json:"service_id"`
+	TemplateID     string          `json:"template_id"`
+	RecipientEmail string          `json:"recipient_email"`
+	RecipientName  string          `json:"recipient_name,omitempty"`
+	Parameters     json.RawMessage `json:"parameters,omitempty"`
+	Cc             json.RawMessage `json:"cc,omitempty"`
+	Bcc            json.RawMessage `json:"bcc,omitempty"`
+	Attachments    json.RawMessage `json:"attachments,omitempty"`
+	Status         Status          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextRunAt      time.Time       `json:"next_run_at"`
+	LastError      string          `json:"last_error,omitempty"`
+}
+
+// Queue enqueues and leases email_jobs rows backed by Supabase.
+type Queue struct {
+	db *supabase.Client
+}
+
+// New returns a Queue backed by db.
+func New(db *supabase.Client) *Queue {
+	return &Queue{db: db}
+}
+
+// NewBatchID returns a random identifier grouping one send request's jobs.
+func NewBatchID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate batch id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Enqueue inserts jobs as pending rows, all runnable immediately.
+func (q *Queue) Enqueue(ctx context.Context, jobs []Job) error {
+	now := time.Now()
+	for i := range jobs {
+		jobs[i].Status = StatusPending
+		jobs[i].NextRunAt = now
+	}
+
+	if err := q.db.DB.From("email_jobs").Insert(jobs).Execute(ctx, nil); err != nil {
+		return fmt.Errorf("failed to enqueue jobs: %v", err)
+	}
+	return nil
+}
+
+// Batch is the set of jobs belonging to one send request.
+type Batch struct {
+	BatchID string `json:"batch_id"`
+	Jobs    []Job  `json:"jobs"`
+}
+
+// GetBatch fetches every job belonging to batchID that was enqueued by
+// userID, so one user can't read another's batch by guessing its id.
+func (q *Queue) GetBatch(ctx context.Context, batchID, userID string) (*Batch, error) {
+	var jobs []Job
+	err := q.db.DB.From("email_jobs").
+		Select("*").
+		Eq("batch_id", batchID).
+		Eq("user_id", userID).
+		Execute(ctx, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch batch: %v", err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("batch not found: %s", batchID)
+	}
+	return &Batch{BatchID: batchID, Jobs: jobs}, nil
+}
+
+// GetJob fetches a single job by id, scoped to userID so one user can't
+// read another's job by guessing its id.
+func (q *Queue) GetJob(ctx context.Context, jobID, userID string) (*Job, error) {
+	var jobs []Job
+	err := q.db.DB.From("email_jobs").
+		Select("*").
+		Eq("job_id", jobID).
+		Eq("user_id", userID).
+		Execute(ctx, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch job: %v", err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job not found: %s", jobID)
+	}
+	return &jobs[0], nil
+}
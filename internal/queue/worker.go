@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Handler processes a single leased job. A non-nil error reschedules
+// the job with backoff unless IsPermanent(err) is true, in which case
+// it is marked failed outright.
+type Handler func(ctx context.Context, job *Job) error
+
+// pollInterval is how often an idle worker checks for pending work.
+const pollInterval = 2 * time.Second
+
+// StartWorkers launches n goroutines that poll q for due jobs and run
+// handler on each until ctx is cancelled.
+func (q *Queue) StartWorkers(ctx context.Context, n int, handler Handler) {
+	for i := 0; i < n; i++ {
+		go q.workerLoop(ctx, handler)
+	}
+}
+
+func (q *Queue) workerLoop(ctx context.Context, handler Handler) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			job, err := q.lease(ctx)
+			if err != nil {
+				log.Printf("queue: failed to lease job: %v", err)
+				continue
+			}
+			if job == nil {
+				continue
+			}
+
+			if sendErr := handler(ctx, job); sendErr != nil {
+				q.reschedule(ctx, job, sendErr)
+			} else {
+				q.markSucceeded(ctx, job)
+			}
+		}
+	}
+}
+
+// lease selects one due pending job and flips it to in_flight. No
+// ordering is applied, so it is not necessarily the oldest due job.
+// The select-then-update is not a single atomic statement, so two
+// workers can in principle race on the same row under heavy
+// contention; an `UPDATE ... RETURNING` RPC would close that gap, but
+// the thin Supabase query builder used elsewhere in this codebase
+// doesn't expose one.
+func (q *Queue) lease(ctx context.Context) (*Job, error) {
+	var jobs []Job
+	// Limit only exists on *SelectRequestBuilder, which Eq/Lte narrow to
+	// *FilterRequestBuilder, so it has to come before them in the chain.
+	err := q.db.DB.From("email_jobs").
+		Select("*").
+		Limit(1).
+		Eq("status", string(StatusPending)).
+		Lte("next_run_at", time.Now().Format(time.RFC3339)).
+		Execute(ctx, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select pending job: %v", err)
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	job := jobs[0]
+	err = q.db.DB.From("email_jobs").
+		Update(map[string]interface{}{"status": string(StatusInFlight)}).
+		Eq("job_id", job.JobID).
+		Eq("status", string(StatusPending)).
+		Execute(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease job %s: %v", job.JobID, err)
+	}
+
+	job.Status = StatusInFlight
+	return &job, nil
+}
+
+func (q *Queue) markSucceeded(ctx context.Context, job *Job) {
+	err := q.db.DB.From("email_jobs").
+		Update(map[string]interface{}{"status": string(StatusSucceeded)}).
+		Eq("job_id", job.JobID).
+		Execute(ctx, nil)
+	if err != nil {
+		log.Printf("queue: failed to mark job %s succeeded: %v", job.JobID, err)
+	}
+}
+
+func (q *Queue) reschedule(ctx context.Context, job *Job, sendErr error) {
+	attempts := job.Attempts + 1
+
+	status := StatusPending
+	if IsPermanent(sendErr) || attempts >= MaxAttempts {
+		status = StatusFailed
+	}
+
+	update := map[string]interface{}{
+		"status":      string(status),
+		"attempts":    attempts,
+		"next_run_at": time.Now().Add(backoff(attempts)).Format(time.RFC3339),
+		"last_error":  sendErr.Error(),
+	}
+	if err := q.db.DB.From("email_jobs").Update(update).Eq("job_id", job.JobID).Execute(ctx, nil); err != nil {
+		log.Printf("queue: failed to reschedule job %s: %v", job.JobID, err)
+	}
+}
+
+// backoff returns an exponential delay for the given retry attempt
+// (1-indexed): the base delay is capped at 5 minutes, then 0-20% of it
+// is added as jitter.
+func backoff(attempt int) time.Duration {
+	base := time.Second * time.Duration(int64(1)<<uint(attempt-1))
+	if base > 5*time.Minute {
+		base = 5 * time.Minute
+	}
+	jitter := time.Duration(rand.Int63n(int64(base)/5 + 1))
+	return base + jitter
+}
+
+// ErrPermanent is a sentinel a Handler can wrap (with %w) to mark a job
+// permanently failed for a reason that isn't an SMTP status code - e.g.
+// a recipient that's been suppressed for a prior hard bounce and will
+// never succeed no matter how many times it's retried.
+var ErrPermanent = errors.New("permanent failure")
+
+// IsPermanent reports whether err should fail a job outright rather
+// than being retried. SMTP 5xx replies are permanent, as is anything
+// wrapping ErrPermanent; 4xx replies, timeouts, and connection errors
+// are transient and get another attempt. err must be unwrappable down
+// to *smtp.SMTPError or ErrPermanent - callers that wrap a send error
+// must use %w, not %v, or every failure looks transient.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrPermanent) {
+		return true
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	return false
+}
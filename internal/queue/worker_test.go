@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TestIsPermanent pins down the case this package's review caught: a
+// wrapped 5xx SMTPError must be detected as permanent so reschedule
+// fails the job outright instead of retrying it up to MaxAttempts.
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "wrapped 550 is permanent",
+			err:  fmt.Errorf("email sending error: %w", &smtp.SMTPError{Code: 550, Message: "mailbox unavailable"}),
+			want: true,
+		},
+		{
+			name: "wrapped 450 is transient",
+			err:  fmt.Errorf("email sending error: %w", &smtp.SMTPError{Code: 450, Message: "try again later"}),
+			want: false,
+		},
+		{
+			name: "non-smtp error is transient",
+			err:  fmt.Errorf("dial tcp: connection refused"),
+			want: false,
+		},
+		{
+			name: "loses the error chain when wrapped with %v",
+			err:  fmt.Errorf("email sending error: %v", &smtp.SMTPError{Code: 550}),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Errorf("IsPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Package ratelimit replaces the old mutable profile.rate_limit
+// counter (read, compare, decrement as three separate round trips,
+// racy under SendEmailsHandler's concurrent fan-out) with a sliding
+// window enforced by a single atomic Postgres RPC.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+
+	supabase "github.com/lengzuo/supa"
+)
+
+// Limiter checks and records send attempts against email_send_events
+// via the check_and_record_send RPC.
+type Limiter struct {
+	db *supabase.Client
+}
+
+// New returns a Limiter backed by db.
+func New(db *supabase.Client) *Limiter {
+	return &Limiter{db: db}
+}
+
+// Result is what check_and_record_send returns for one bucket.
+type Result struct {
+	Allowed        bool `json:"allowed"`
+	Remaining      int  `json:"remaining"`
+	RetryAfterSecs int  `json:"retry_after_seconds"`
+}
+
+// Check atomically counts email_send_events matching (scopeType,
+// scopeValue) within the trailing windowSeconds and inserts a new
+// event iff that count is still under limit, in one round trip. This
+// consumes a slot, so it must be called exactly once per actual send
+// attempt (processJob's per-recipient check) - never to gate
+// acceptance of a whole batch, or every batch burns an extra slot per
+// recipient it contains. Use Peek for that.
+// scopeType is "user", "service", or "recipient_domain" so a single
+// runaway campaign against one service or domain can't exhaust a
+// user's whole account quota.
+func (l *Limiter) Check(ctx context.Context, scopeType, scopeValue string, limit, windowSeconds int) (*Result, error) {
+	return l.check(ctx, scopeType, scopeValue, limit, windowSeconds, true)
+}
+
+// Peek reports whether a send would currently be allowed without
+// consuming a slot. Use this to gate/report quota at accept time
+// (e.g. SendEmailsHandler, before any job has actually been attempted)
+// so the batch's later per-recipient Check calls remain the only thing
+// that consumes the window.
+func (l *Limiter) Peek(ctx context.Context, scopeType, scopeValue string, limit, windowSeconds int) (*Result, error) {
+	return l.check(ctx, scopeType, scopeValue, limit, windowSeconds, false)
+}
+
+func (l *Limiter) check(ctx context.Context, scopeType, scopeValue string, limit, windowSeconds int, consume bool) (*Result, error) {
+	var results []Result
+	err := l.db.DB.RPC("check_and_record_send", map[string]interface{}{
+		"p_scope_type":     scopeType,
+		"p_scope_value":    scopeValue,
+		"p_limit":          limit,
+		"p_window_seconds": windowSeconds,
+		"p_consume":        consume,
+	}).Execute(ctx, &results)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit check failed: %v", err)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("rate limit check returned no result")
+	}
+	return &results[0], nil
+}
@@ -2,46 +2,83 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url" // Added import
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"text/template"
 	"time"
 
-	"net/smtp"
-
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	supabase "github.com/lengzuo/supa"
+
+	"nextinbox/internal/deliveries"
+	"nextinbox/internal/inbound"
+	"nextinbox/internal/mail"
+	"nextinbox/internal/mailbuilder"
+	"nextinbox/internal/queue"
+	"nextinbox/internal/ratelimit"
 )
 
+// numWorkers is how many goroutines poll the send queue for due jobs.
+const numWorkers = 5
+
 type MailService struct {
-	supaClient *supabase.Client
-	services   map[string]Service
+	supaClient   *supabase.Client
+	services     map[string]Service
+	queue        *queue.Queue
+	rateLimiter  *ratelimit.Limiter
+	smtpSender   SMTPSender
+	deliveries   *deliveries.Tracker
+	bounceDomain string
+}
+
+// SMTPSender is the seam processJob actually sends mail through. It has
+// the same shape as mail.Provider, so any provider built by mail.New
+// satisfies it without an adapter; tests can instead inject
+// mail.FakeSender via WithSMTPSender to exercise the full pipeline
+// without a live SMTP server.
+type SMTPSender interface {
+	Send(ctx context.Context, msg mail.Message) error
 }
 
 type Service struct {
-	ServiceID   string `json:"service_id"`
-	UserID      string `json:"user_id"`
-	HostAddress string `json:"host_address"`
-	Port        int    `json:"port"`
-	EmailID     string `json:"email_id"`
-	Password    string `json:"password"`
-	CorsOrigin  string `json:"cors_origin"` // Add CorsOrigin field
+	ServiceID      string          `json:"service_id"`
+	UserID         string          `json:"user_id"`
+	HostAddress    string          `json:"host_address"`
+	Port           int             `json:"port"`
+	EmailID        string          `json:"email_id"`
+	Password       string          `json:"password"`
+	CorsOrigin     string          `json:"cors_origin"`     // Add CorsOrigin field
+	Provider       string          `json:"provider"`        // "smtp" (default), "mailwhale", "sendgrid", "ses"
+	ProviderConfig json.RawMessage `json:"provider_config"` // provider-specific credentials, unused by "smtp"
+
+	DKIMSelector      string `json:"dkim_selector,omitempty"`
+	DKIMPrivateKeyPEM string `json:"dkim_private_key_pem,omitempty"`
+	TLSMode           string `json:"tls_mode,omitempty"` // "starttls" (default), "implicit", "plain"
+	TLSSkipVerify     bool   `json:"tls_skip_verify,omitempty"`
+
+	// RateLimitPerWindow, if set, caps this service's own sliding-window
+	// bucket so one service can't burn a user's whole account quota.
+	RateLimitPerWindow int `json:"rate_limit_per_window,omitempty"`
 }
 
 // Update the EmailRequest struct
 type EmailRequest struct {
-	UserKey    string                 `json:"user_key"` // Changed from UserID
-	ServiceID  string                 `json:"service_id"`
-	TemplateID string                 `json:"template_id"`
-	Recipients []Recipient            `json:"recipients"`
-	Parameters map[string]interface{} `json:"parameters"`
+	UserKey     string                 `json:"user_key"` // Changed from UserID
+	ServiceID   string                 `json:"service_id"`
+	TemplateID  string                 `json:"template_id"`
+	Recipients  []Recipient            `json:"recipients"`
+	Cc          []Recipient            `json:"cc,omitempty"`
+	Bcc         []Recipient            `json:"bcc,omitempty"`
+	Attachments []Attachment           `json:"attachments,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters"`
 }
 
 type Recipient struct {
@@ -49,12 +86,34 @@ type Recipient struct {
 	Name         string `json:"name,omitempty"`
 }
 
+// Attachment is a file to send alongside the email, either as a regular
+// attachment or, when Inline is true, as an inline image referenced
+// from the template's HTML via `cid:<ContentID>`.
+type Attachment struct {
+	Filename      string `json:"filename"`
+	ContentType   string `json:"content_type"`
+	ContentBase64 string `json:"content_base64"`
+	Inline        bool   `json:"inline,omitempty"`
+	ContentID     string `json:"content_id,omitempty"`
+}
+
 type EmailResponse struct {
 	Success bool     `json:"success"`
 	Errors  []string `json:"errors,omitempty"`
 }
 
-func NewMailService() (*MailService, error) {
+// Option configures a MailService built by NewMailService.
+type Option func(*MailService)
+
+// WithSMTPSender overrides the SMTPSender processJob sends through,
+// letting tests inject mail.FakeSender instead of a live mail.Provider.
+func WithSMTPSender(sender SMTPSender) Option {
+	return func(ms *MailService) {
+		ms.smtpSender = sender
+	}
+}
+
+func NewMailService(opts ...Option) (*MailService, error) {
 	err := godotenv.Load()
 	if err != nil {
 		return nil, fmt.Errorf("error loading .env file: %v", err)
@@ -71,10 +130,40 @@ func NewMailService() (*MailService, error) {
 		return nil, fmt.Errorf("failed to initialize Supabase client: %v", err)
 	}
 
-	return &MailService{
-		supaClient: supaClient,
-		services:   make(map[string]Service),
-	}, nil
+	bounceDomain := os.Getenv("BOUNCE_DOMAIN")
+	if bounceDomain == "" {
+		bounceDomain = defaultBounceDomain
+	}
+
+	ms := &MailService{
+		supaClient:   supaClient,
+		services:     make(map[string]Service),
+		queue:        queue.New(supaClient),
+		rateLimiter:  ratelimit.New(supaClient),
+		deliveries:   deliveries.New(supaClient),
+		bounceDomain: bounceDomain,
+	}
+	for _, opt := range opts {
+		opt(ms)
+	}
+	return ms, nil
+}
+
+// defaultBounceDomain is used when BOUNCE_DOMAIN isn't set; it only
+// matters once DNS/MX for it actually points at the inbound listener.
+const defaultBounceDomain = "bounces.example.com"
+
+// defaultInboundSMTPAddr is used when INBOUND_SMTP_ADDR isn't set.
+const defaultInboundSMTPAddr = ":2525"
+
+// defaultRateLimitWindowSeconds is used when a profile has no explicit
+// rate_limit_window_seconds set.
+const defaultRateLimitWindowSeconds = 3600
+
+// BatchResponse is returned by SendEmailsHandler once every recipient
+// has been durably enqueued; the actual sends happen asynchronously.
+type BatchResponse struct {
+	BatchID string `json:"batch_id"`
 }
 
 func (ms *MailService) SendEmailsHandler(w http.ResponseWriter, r *http.Request) {
@@ -84,33 +173,242 @@ func (ms *MailService) SendEmailsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	response := EmailResponse{Success: true}
-	var wg sync.WaitGroup
-	errorChan := make(chan error, len(req.Recipients))
+	ctx := r.Context()
+
+	userID, err := ms.getUserIDFromKey(ctx, req.UserKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	var services []Service
+	err = ms.supaClient.DB.From("services").
+		Select("*").
+		Eq("service_id", req.ServiceID).
+		Eq("user_id", userID).
+		Execute(ctx, &services)
+	if err != nil || len(services) == 0 {
+		http.Error(w, "invalid service_id", http.StatusBadRequest)
+		return
+	}
+
+	// CORS/origin validation happens once, up front, because queued
+	// jobs are sent later by a worker with no HTTP request in scope.
+	if err := checkOriginAllowed(services[0], r.Header.Get("Origin")); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var profiles []struct {
+		RateLimitPerWindow     int `json:"rate_limit_per_window"`
+		RateLimitWindowSeconds int `json:"rate_limit_window_seconds"`
+	}
+	err = ms.supaClient.DB.From("profile").
+		Select("rate_limit_per_window", "rate_limit_window_seconds").
+		Eq("user_id", userID).
+		Execute(ctx, &profiles)
+	if err != nil || len(profiles) == 0 {
+		http.Error(w, "failed to fetch rate limit profile", http.StatusInternalServerError)
+		return
+	}
+
+	windowSeconds := profiles[0].RateLimitWindowSeconds
+	if windowSeconds <= 0 {
+		windowSeconds = defaultRateLimitWindowSeconds
+	}
+
+	// Peek, not Check: this only gates/reports acceptance of the batch.
+	// Each recipient's actual send consumes its own slot later via
+	// processJob's Check, so this must not consume one too or a batch
+	// of N recipients would burn N+1 slots for N sends.
+	quota, err := ms.rateLimiter.Peek(ctx, "user", userID, profiles[0].RateLimitPerWindow, windowSeconds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(quota.Remaining))
+	if !quota.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(quota.RetryAfterSecs))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	parameters, err := json.Marshal(req.Parameters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid parameters: %v", err), http.StatusBadRequest)
+		return
+	}
+	cc, err := json.Marshal(req.Cc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid cc: %v", err), http.StatusBadRequest)
+		return
+	}
+	bcc, err := json.Marshal(req.Bcc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid bcc: %v", err), http.StatusBadRequest)
+		return
+	}
+	attachments, err := json.Marshal(req.Attachments)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid attachments: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	batchID, err := queue.NewBatchID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	jobs := make([]queue.Job, 0, len(req.Recipients))
 	for _, recipient := range req.Recipients {
-		wg.Add(1)
-		go func(rec Recipient) {
-			defer wg.Done()
-			// Pass the request object to sendSingleEmail
-			if err := ms.sendSingleEmail(&req, rec, r); err != nil {
-				errorChan <- fmt.Errorf("error sending to %s: %v", rec.EmailAddress, err)
-			}
-		}(recipient)
+		jobs = append(jobs, queue.Job{
+			BatchID:        batchID,
+			UserID:         userID,
+			ServiceID:      req.ServiceID,
+			TemplateID:     req.TemplateID,
+			RecipientEmail: recipient.EmailAddress,
+			RecipientName:  recipient.Name,
+			Parameters:     parameters,
+			Cc:             cc,
+			Bcc:            bcc,
+			Attachments:    attachments,
+		})
+	}
+
+	if err := ms.queue.Enqueue(ctx, jobs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	go func() {
-		wg.Wait()
-		close(errorChan)
-	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(BatchResponse{BatchID: batchID})
+}
+
+// VerifyServiceHandler opens a connection to a service's mail server
+// and reports what it negotiates (STARTTLS, AUTH mechanisms, whether
+// the stored credentials authenticate) without sending a real email,
+// so misconfigured SMTP settings can be debugged directly.
+func (ms *MailService) VerifyServiceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := ms.getUserIDFromKey(ctx, r.URL.Query().Get("user_key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	var services []Service
+	err = ms.supaClient.DB.From("services").
+		Select("*").
+		Eq("service_id", mux.Vars(r)["id"]).
+		Eq("user_id", userID).
+		Execute(ctx, &services)
+	if err != nil || len(services) == 0 {
+		http.Error(w, "invalid service_id", http.StatusBadRequest)
+		return
+	}
+	service := services[0]
+
+	result, err := mail.VerifySMTP(mail.Config{
+		HostAddress:   service.HostAddress,
+		Port:          service.Port,
+		EmailID:       service.EmailID,
+		Password:      service.Password,
+		TLSMode:       service.TLSMode,
+		TLSSkipVerify: service.TLSSkipVerify,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (ms *MailService) GetBatchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := ms.getUserIDFromKey(ctx, r.URL.Query().Get("user_key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	batch, err := ms.queue.GetBatch(ctx, mux.Vars(r)["id"], userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+func (ms *MailService) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := ms.getUserIDFromKey(ctx, r.URL.Query().Get("user_key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	job, err := ms.queue.GetJob(ctx, mux.Vars(r)["id"], userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
 
-	for err := range errorChan {
-		response.Success = false
-		response.Errors = append(response.Errors, err.Error())
+// GetDeliveryHandler reports what, if anything, the inbound bounce
+// listener has learned about a send since its SMTP handoff.
+func (ms *MailService) GetDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := ms.getUserIDFromKey(ctx, r.URL.Query().Get("user_key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
 	}
 
+	delivery, err := ms.deliveries.GetForUser(ctx, mux.Vars(r)["message_id"], userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// checkOriginAllowed enforces service.CorsOrigin against the request's
+// Origin header, matching scheme and hostname (or subdomain).
+func checkOriginAllowed(service Service, origin string) error {
+	if service.CorsOrigin == "" {
+		return nil
+	}
+
+	parsedOrigin, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin: %s", origin)
+	}
+
+	allowedOrigins := strings.Split(service.CorsOrigin, ",")
+	for _, allowedOrigin := range allowedOrigins {
+		allowedOrigin = strings.TrimSpace(allowedOrigin)
+		parsedAllowedOrigin, err := url.Parse(allowedOrigin)
+		if err != nil {
+			continue // Skip invalid allowed origins
+		}
+		if parsedAllowedOrigin.Scheme != parsedOrigin.Scheme {
+			continue
+		}
+		if parsedOrigin.Hostname() == parsedAllowedOrigin.Hostname() ||
+			strings.HasSuffix(parsedOrigin.Hostname(), "."+parsedAllowedOrigin.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin not allowed: %s", origin)
 }
 
 // Add new function to get user_id from user_key
@@ -153,38 +451,229 @@ type EmailEntry struct {
 	PhoneNumber  string `json:"phone_number,omitempty"`
 }
 
-// Modify sendSingleEmail function
-func (ms *MailService) sendSingleEmail(req *EmailRequest, recipient Recipient, r *http.Request) error {
-	ctx := context.Background()
+// TemplateData is the subset of the templates table needed to render
+// one email; shared by processJob and PreviewTemplateHandler so a
+// template renders identically whether it's actually sent or previewed.
+type TemplateData struct {
+	Content           string `json:"content"`
+	Subject           string `json:"subject"`
+	PlainTextTemplate string `json:"plain_text_template,omitempty"`
+}
+
+// templateFuncMap is the function map available to every template,
+// shared by the live send path and the preview endpoint.
+var templateFuncMap = template.FuncMap{
+	"formatDate": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"title": strings.Title,
+}
+
+// renderTemplate executes tmplData's HTML template, and its plain-text
+// counterpart if one is set, against recipient/parameters.
+func renderTemplate(tmplData TemplateData, recipient Recipient, parameters map[string]interface{}) (html string, plainText string, err error) {
+	tmpl, err := template.New("email").Funcs(templateFuncMap).Parse(tmplData.Content)
+	if err != nil {
+		return "", "", fmt.Errorf("template parsing error: %v", err)
+	}
+
+	templateContext := map[string]interface{}{
+		"recipient": recipient,
+		"params":    parameters,
+	}
+
+	var body strings.Builder
+	if err := tmpl.Execute(&body, templateContext); err != nil {
+		return "", "", fmt.Errorf("template execution error: %v", err)
+	}
+
+	if tmplData.PlainTextTemplate == "" {
+		return body.String(), "", nil
+	}
+
+	plainTmpl, err := template.New("email-plain").Funcs(templateFuncMap).Parse(tmplData.PlainTextTemplate)
+	if err != nil {
+		return "", "", fmt.Errorf("plain text template parsing error: %v", err)
+	}
+	var plainBody strings.Builder
+	if err := plainTmpl.Execute(&plainBody, templateContext); err != nil {
+		return "", "", fmt.Errorf("plain text template execution error: %v", err)
+	}
+	return body.String(), plainBody.String(), nil
+}
+
+// parseDateParameter replaces a "date" parameter holding an RFC 3339
+// string with the parsed time.Time, so templates can call formatDate on
+// it the same way whether the value came from a queued job or a preview
+// request.
+func parseDateParameter(parameters map[string]interface{}) error {
+	rawDate, ok := parameters["date"].(string)
+	if !ok {
+		return nil
+	}
+	parsedDate, err := time.Parse(time.RFC3339, rawDate)
+	if err != nil {
+		return fmt.Errorf("invalid date format: %v", err)
+	}
+	parameters["date"] = parsedDate
+	return nil
+}
+
+// TemplatePreviewRequest is the body accepted by POST /templates/{id}/preview.
+type TemplatePreviewRequest struct {
+	UserKey    string                 `json:"user_key"`
+	ServiceID  string                 `json:"service_id"`
+	Recipient  Recipient              `json:"recipient"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// TemplatePreviewResponse is what a preview renders. No SMTP server is
+// ever contacted for it.
+type TemplatePreviewResponse struct {
+	Subject string            `json:"subject"`
+	Headers map[string]string `json:"headers"`
+	HTML    string            `json:"html"`
+	Raw     string            `json:"raw"` // RFC 5322 wire bytes
+}
+
+// PreviewTemplateHandler resolves a template exactly like processJob —
+// same funcMap, same date parsing, same mailbuilder header assembly —
+// and returns the rendered subject, headers, HTML body, and raw RFC
+// 5322 bytes, so a broken template surfaces before a real send is
+// attempted instead of only showing up in a failure log afterwards.
+func (ms *MailService) PreviewTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var req TemplatePreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
 
-	// First get the user_id from user_key
 	userID, err := ms.getUserIDFromKey(ctx, req.UserKey)
 	if err != nil {
-		return fmt.Errorf("invalid user_key: %v", err)
+		http.Error(w, fmt.Sprintf("invalid user_key: %v", err), http.StatusUnauthorized)
+		return
 	}
 
-	// Fetch the user's rate_limit from the profile table
-	var profiles []struct {
-		RateLimit int `json:"rate_limit"`
+	var services []Service
+	err = ms.supaClient.DB.From("services").
+		Select("*").
+		Eq("service_id", req.ServiceID).
+		Eq("user_id", userID).
+		Execute(ctx, &services)
+	if err != nil || len(services) == 0 {
+		http.Error(w, "invalid service_id", http.StatusBadRequest)
+		return
 	}
-	err = ms.supaClient.DB.From("profile").
-		Select("rate_limit").
+	service := services[0]
+
+	var templates []TemplateData
+	err = ms.supaClient.DB.From("templates").
+		Select("content", "subject", "plain_text_template").
+		Eq("template_id", mux.Vars(r)["id"]).
 		Eq("user_id", userID).
+		Execute(ctx, &templates)
+	if err != nil || len(templates) == 0 {
+		http.Error(w, "invalid template_id", http.StatusBadRequest)
+		return
+	}
+	tmplData := templates[0]
+
+	parameters := req.Parameters
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	if err := parseDateParameter(parameters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	html, plainText, err := renderTemplate(tmplData, req.Recipient, parameters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	raw, err := mailbuilder.Build(mailbuilder.Params{
+		From:      service.EmailID,
+		To:        req.Recipient.EmailAddress,
+		Subject:   tmplData.Subject,
+		HTML:      html,
+		PlainText: plainText,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build mime message: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TemplatePreviewResponse{
+		Subject: tmplData.Subject,
+		Headers: map[string]string{
+			"From":    service.EmailID,
+			"To":      req.Recipient.EmailAddress,
+			"Subject": tmplData.Subject,
+		},
+		HTML: html,
+		Raw:  string(raw),
+	})
+}
+
+// processJob is the send path run by the queue workers for one leased
+// job. Origin/CORS validation already happened in SendEmailsHandler
+// before the job was enqueued, so there's no *http.Request in scope here.
+func (ms *MailService) processJob(ctx context.Context, job *queue.Job) error {
+	// Fetch the user's rate limit settings and per-send attachment cap
+	var profiles []struct {
+		RateLimitPerWindow       int `json:"rate_limit_per_window"`
+		RateLimitWindowSeconds   int `json:"rate_limit_window_seconds"`
+		DomainRateLimitPerWindow int `json:"domain_rate_limit_per_window"`
+		MaxAttachmentSize        int `json:"max_attachment_size_bytes"`
+	}
+	err := ms.supaClient.DB.From("profile").
+		Select("rate_limit_per_window", "rate_limit_window_seconds", "domain_rate_limit_per_window", "max_attachment_size_bytes").
+		Eq("user_id", job.UserID).
 		Execute(ctx, &profiles)
 	if err != nil || len(profiles) == 0 {
 		return fmt.Errorf("failed to fetch user's rate limit: %v", err)
 	}
 
-	// Check if rate_limit is greater than zero
-	if profiles[0].RateLimit <= 0 {
-		return fmt.Errorf("rate limit exceeded")
+	windowSeconds := profiles[0].RateLimitWindowSeconds
+	if windowSeconds <= 0 {
+		windowSeconds = defaultRateLimitWindowSeconds
+	}
+
+	// Checked before any rate limit Check consumes a slot: a suppressed
+	// recipient can never succeed, so there's no point spending up to
+	// MaxAttempts worth of quota retrying it.
+	suppressed, err := ms.deliveries.IsSuppressed(ctx, job.UserID, job.RecipientEmail)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return fmt.Errorf("recipient %s is suppressed due to a prior hard bounce: %w", job.RecipientEmail, queue.ErrPermanent)
+	}
+
+	// SendEmailsHandler only peeked at the user-level bucket to decide
+	// whether to accept the batch; this is the sole check that
+	// consumes a slot, since jobs can run well after (and well apart
+	// from) the HTTP request that enqueued them.
+	userQuota, err := ms.rateLimiter.Check(ctx, "user", job.UserID, profiles[0].RateLimitPerWindow, windowSeconds)
+	if err != nil {
+		return err
+	}
+	if !userQuota.Allowed {
+		return fmt.Errorf("rate limit exceeded for account, retry after %ds", userQuota.RetryAfterSecs)
 	}
 
 	var services []Service
 	err = ms.supaClient.DB.From("services").
 		Select("*").
-		Eq("service_id", req.ServiceID).
-		Eq("user_id", userID). // Use resolved userID
+		Eq("service_id", job.ServiceID).
+		Eq("user_id", job.UserID).
 		Execute(ctx, &services)
 	if err != nil || len(services) == 0 {
 		return fmt.Errorf("invalid service_id")
@@ -192,143 +681,155 @@ func (ms *MailService) sendSingleEmail(req *EmailRequest, recipient Recipient, r
 
 	service := services[0]
 
-	// Capture the Origin header from the request
-	origin := r.Header.Get("Origin")
-	log.Printf("Incoming request origin: %s", origin) // Added log for debugging
-
-	// Parse the origin
-	parsedOrigin, err := url.Parse(origin)
-	if err != nil {
-		return fmt.Errorf("invalid origin: %s", origin)
+	if service.RateLimitPerWindow > 0 {
+		serviceQuota, err := ms.rateLimiter.Check(ctx, "service", job.ServiceID, service.RateLimitPerWindow, windowSeconds)
+		if err != nil {
+			return err
+		}
+		if !serviceQuota.Allowed {
+			return fmt.Errorf("rate limit exceeded for service, retry after %ds", serviceQuota.RetryAfterSecs)
+		}
 	}
 
-	// Check if the request's origin is allowed
-	if service.CorsOrigin != "" {
-		allowedOrigins := strings.Split(service.CorsOrigin, ",")
-		originAllowed := false
-		for _, allowedOrigin := range allowedOrigins {
-			allowedOrigin = strings.TrimSpace(allowedOrigin)
-			// Parse the allowed origin
-			parsedAllowedOrigin, err := url.Parse(allowedOrigin)
-			if err != nil {
-				continue // Skip invalid allowed origins
-			}
-			// Compare scheme
-			if parsedAllowedOrigin.Scheme != parsedOrigin.Scheme {
-				continue
-			}
-			// Check if origin hostname is the same or a subdomain
-			if parsedOrigin.Hostname() == parsedAllowedOrigin.Hostname() ||
-				strings.HasSuffix(parsedOrigin.Hostname(), "."+parsedAllowedOrigin.Hostname()) {
-				originAllowed = true
-				break
-			}
+	if profiles[0].DomainRateLimitPerWindow > 0 {
+		domainQuota, err := ms.rateLimiter.Check(ctx, "recipient_domain", recipientDomain(job.RecipientEmail), profiles[0].DomainRateLimitPerWindow, windowSeconds)
+		if err != nil {
+			return err
 		}
-		if !originAllowed {
-			return fmt.Errorf("origin not allowed: %s", origin)
+		if !domainQuota.Allowed {
+			return fmt.Errorf("rate limit exceeded for recipient domain, retry after %ds", domainQuota.RetryAfterSecs)
 		}
 	}
 
-	if rawDate, ok := req.Parameters["date"].(string); ok {
-		parsedDate, err := time.Parse(time.RFC3339, rawDate)
-		if err != nil {
-			return fmt.Errorf("invalid date format: %v", err)
+	var parameters map[string]interface{}
+	if len(job.Parameters) > 0 {
+		if err := json.Unmarshal(job.Parameters, &parameters); err != nil {
+			return fmt.Errorf("invalid parameters: %v", err)
 		}
-		req.Parameters["date"] = parsedDate
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
 	}
 
-	var templates []struct {
-		Content string `json:"content"`
-		Subject string `json:"subject"`
+	if err := parseDateParameter(parameters); err != nil {
+		return err
 	}
+
+	var templates []TemplateData
 	err = ms.supaClient.DB.From("templates").
-		Select("content", "subject").
-		Eq("template_id", req.TemplateID).
-		Eq("user_id", userID). // Use resolved userID
+		Select("content", "subject", "plain_text_template").
+		Eq("template_id", job.TemplateID).
+		Eq("user_id", job.UserID).
 		Execute(ctx, &templates)
 	if err != nil || len(templates) == 0 {
 		return fmt.Errorf("invalid template_id")
 	}
 
 	tmplData := templates[0]
+	recipient := Recipient{EmailAddress: job.RecipientEmail, Name: job.RecipientName}
 
-	// Create template with function map for additional template functionality
-	funcMap := template.FuncMap{
-		"formatDate": func(t time.Time) string {
-			return t.Format("2006-01-02 15:04:05")
-		},
-		"upper": strings.ToUpper,
-		"lower": strings.ToLower,
-		"title": strings.Title,
+	html, plainText, err := renderTemplate(tmplData, recipient, parameters)
+	if err != nil {
+		return err
+	}
+	if plainText == "" {
+		plainText = mailbuilder.StripHTML(html)
 	}
 
-	tmpl, err := template.New("email").Funcs(funcMap).Parse(tmplData.Content)
+	attachments, totalAttachmentBytes, err := decodeAttachments(job.Attachments)
 	if err != nil {
-		return fmt.Errorf("template parsing error: %v", err)
+		return fmt.Errorf("invalid attachments: %v", err)
 	}
-
-	// Create template context with recipient data and parameters
-	templateContext := map[string]interface{}{
-		"recipient": recipient,
-		"params":    req.Parameters,
+	if profiles[0].MaxAttachmentSize > 0 && totalAttachmentBytes > profiles[0].MaxAttachmentSize {
+		return fmt.Errorf("attachments exceed the %d byte limit for this account", profiles[0].MaxAttachmentSize)
 	}
 
-	var body strings.Builder
-	if err := tmpl.Execute(&body, templateContext); err != nil {
-		return fmt.Errorf("template execution error: %v", err)
+	cc, err := decodeEmailAddresses(job.Cc)
+	if err != nil {
+		return fmt.Errorf("invalid cc: %v", err)
 	}
-
-	headers := map[string]string{
-		"MIME-Version":              "1.0",
-		"Content-Type":              "text/html; charset=UTF-8",
-		"Subject":                   tmplData.Subject,
-		"From":                      service.EmailID,
-		"To":                        recipient.EmailAddress,
-		"X-Priority":                "3",
-		"X-Mailer":                  "Portfolio Mailer",
-		"Content-Transfer-Encoding": "8bit",
+	bcc, err := decodeEmailAddresses(job.Bcc)
+	if err != nil {
+		return fmt.Errorf("invalid bcc: %v", err)
 	}
 
-	var message strings.Builder
-	for key, value := range headers {
-		message.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+	deliveryID, err := deliveries.NewMessageID()
+	if err != nil {
+		return err
+	}
+	messageID := fmt.Sprintf("%s@%s", deliveryID, recipientDomain(service.EmailID))
+	bounceAddress := deliveries.BounceAddress(ms.bounceDomain, job.ServiceID, deliveryID)
+
+	raw, err := mailbuilder.Build(mailbuilder.Params{
+		From:        service.EmailID,
+		To:          recipient.EmailAddress,
+		Cc:          cc,
+		Bcc:         bcc,
+		Subject:     tmplData.Subject,
+		HTML:        html,
+		PlainText:   plainText,
+		Attachments: attachments,
+		MessageID:   messageID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build mime message: %v", err)
+	}
+
+	sender := ms.smtpSender
+	if sender == nil {
+		sender, err = mail.New(service.Provider, mail.Config{
+			HostAddress:       service.HostAddress,
+			Port:              service.Port,
+			EmailID:           service.EmailID,
+			Password:          service.Password,
+			ProviderConfig:    service.ProviderConfig,
+			TLSMode:           service.TLSMode,
+			TLSSkipVerify:     service.TLSSkipVerify,
+			DKIMSelector:      service.DKIMSelector,
+			DKIMPrivateKeyPEM: service.DKIMPrivateKeyPEM,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to build mail provider: %v", err)
+		}
 	}
-	message.WriteString("\r\n")
-	message.WriteString(body.String())
-
-	auth := smtp.PlainAuth("", service.EmailID, service.Password, service.HostAddress)
 
 	// Attempt to send the email
-	err = smtp.SendMail(
-		fmt.Sprintf("%s:%d", service.HostAddress, service.Port),
-		auth,
-		service.EmailID,
-		[]string{recipient.EmailAddress},
-		[]byte(message.String()),
-	)
-
-	// Decrement the rate_limit only if email was sent successfully
+	err = sender.Send(ctx, mail.Message{
+		From:         service.EmailID,
+		EnvelopeFrom: bounceAddress,
+		To:           recipient.EmailAddress,
+		Cc:           cc,
+		Bcc:          bcc,
+		Subject:      tmplData.Subject,
+		HTML:         html,
+		PlainText:    plainText,
+		Attachments:  attachments,
+		Raw:          raw,
+	})
+
+	// Quota was already recorded atomically by the rate limit checks
+	// above, regardless of how the send itself turns out.
+
+	// Once the message has actually been handed off, track it so a
+	// later DSN/ARF report addressed to bounceAddress can be matched
+	// back to this send.
 	if err == nil {
-		updatedProfile := struct {
-			RateLimit int `json:"rate_limit"`
-		}{
-			RateLimit: profiles[0].RateLimit - 1,
-		}
-
-		err = ms.supaClient.DB.From("profile").
-			Update(updatedProfile).
-			Eq("user_id", userID).
-			Execute(ctx, nil)
-		if err != nil {
-			log.Printf("Failed to update user's rate limit: %v", err)
+		if recErr := ms.deliveries.Record(ctx, deliveries.Delivery{
+			MessageID:      deliveryID,
+			UserID:         job.UserID,
+			ServiceID:      job.ServiceID,
+			TemplateID:     job.TemplateID,
+			RecipientEmail: recipient.EmailAddress,
+		}); recErr != nil {
+			log.Printf("Failed to record delivery: %v", recErr)
 		}
 	}
 
 	// Create log entry regardless of success or failure
 	logEntry := LogEntry{
-		UserID:     userID,
-		ServiceID:  req.ServiceID,
-		TemplateID: req.TemplateID,
+		UserID:     job.UserID,
+		ServiceID:  job.ServiceID,
+		TemplateID: job.TemplateID,
 		Status:     "success",
 		Message:    fmt.Sprintf("Email sent to %s", recipient.EmailAddress),
 	}
@@ -344,25 +845,25 @@ func (ms *MailService) sendSingleEmail(req *EmailRequest, recipient Recipient, r
 	}
 
 	if err != nil {
-		return fmt.Errorf("email sending error: %v", err)
+		return fmt.Errorf("email sending error: %w", err)
 	}
 
 	// Check if the email entry already exists
 	var existingEmails []EmailEntry
 	err = ms.supaClient.DB.From("emails").
 		Select("*").
-		Eq("user_id", userID).
+		Eq("user_id", job.UserID).
 		Eq("email_address", recipient.EmailAddress).
-		Eq("template_id", req.TemplateID).
+		Eq("template_id", job.TemplateID).
 		Execute(ctx, &existingEmails)
 	if err != nil {
 		log.Printf("Failed to check existing emails: %v", err)
 	} else if len(existingEmails) == 0 {
 		// Create email entry since it doesn't exist
 		emailEntry := EmailEntry{
-			UserID:       userID,
-			ServiceID:    req.ServiceID,
-			TemplateID:   req.TemplateID,
+			UserID:       job.UserID,
+			ServiceID:    job.ServiceID,
+			TemplateID:   job.TemplateID,
 			EmailAddress: recipient.EmailAddress,
 			Name:         recipient.Name,
 			PhoneNumber:  "", // Add PhoneNumber field to match the emails table schema
@@ -376,6 +877,66 @@ func (ms *MailService) sendSingleEmail(req *EmailRequest, recipient Recipient, r
 	return nil
 }
 
+// recipientDomain returns the part of an email address after the "@",
+// used as the bucket key for the per-recipient-domain rate limit.
+func recipientDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i != -1 {
+		return email[i+1:]
+	}
+	return email
+}
+
+// decodeAttachments turns a job's JSON-encoded Attachments blob into
+// mailbuilder.Attachment values, base64-decoding their content, and
+// reports the total decoded size so callers can enforce a cap.
+func decodeAttachments(raw json.RawMessage) ([]mailbuilder.Attachment, int, error) {
+	if len(raw) == 0 {
+		return nil, 0, nil
+	}
+
+	var requested []Attachment
+	if err := json.Unmarshal(raw, &requested); err != nil {
+		return nil, 0, err
+	}
+
+	attachments := make([]mailbuilder.Attachment, 0, len(requested))
+	total := 0
+	for _, a := range requested {
+		content, err := base64.StdEncoding.DecodeString(a.ContentBase64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", a.Filename, err)
+		}
+		total += len(content)
+		attachments = append(attachments, mailbuilder.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     content,
+			Inline:      a.Inline,
+			ContentID:   a.ContentID,
+		})
+	}
+	return attachments, total, nil
+}
+
+// decodeEmailAddresses turns a job's JSON-encoded Cc/Bcc blob into a
+// flat list of email addresses.
+func decodeEmailAddresses(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var recipients []Recipient
+	if err := json.Unmarshal(raw, &recipients); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		addresses = append(addresses, r.EmailAddress)
+	}
+	return addresses, nil
+}
+
 func (ms *MailService) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
@@ -387,11 +948,41 @@ func main() {
 		log.Fatalf("Failed to initialize mail service: %v", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mailService.queue.StartWorkers(ctx, numWorkers, mailService.processJob)
+
+	inboundAddr := os.Getenv("INBOUND_SMTP_ADDR")
+	if inboundAddr == "" {
+		inboundAddr = defaultInboundSMTPAddr
+	}
+	inboundServer := inbound.New(inboundAddr, mailService.deliveries)
+	go func() {
+		log.Printf("Inbound bounce/complaint listener starting on %s", inboundAddr)
+		if err := inboundServer.ListenAndServe(); err != nil {
+			log.Printf("inbound SMTP server stopped: %v", err)
+		}
+	}()
+
 	r := mux.NewRouter()
 
 	// Email sending endpoint
 	r.HandleFunc("/send-emails", mailService.SendEmailsHandler).Methods("POST")
 
+	// Batch/job status endpoints
+	r.HandleFunc("/batches/{id}", mailService.GetBatchHandler).Methods("GET")
+	r.HandleFunc("/jobs/{id}", mailService.GetJobHandler).Methods("GET")
+
+	// Delivery status endpoint, updated asynchronously by the inbound
+	// bounce/complaint listener
+	r.HandleFunc("/deliveries/{message_id}", mailService.GetDeliveryHandler).Methods("GET")
+
+	// SMTP configuration debugging endpoint
+	r.HandleFunc("/services/{id}/verify", mailService.VerifyServiceHandler).Methods("POST")
+
+	// Template dry-run endpoint: renders a template without sending it
+	r.HandleFunc("/templates/{id}/preview", mailService.PreviewTemplateHandler).Methods("POST")
+
 	// Health check endpoint
 	r.HandleFunc("/health", mailService.HealthCheckHandler).Methods("GET")
 
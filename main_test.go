@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"nextinbox/internal/mail"
+	"nextinbox/internal/mailbuilder"
+)
+
+// TestRenderBuildSendPipeline exercises the same render -> build ->
+// send sequence processJob runs, but against a FakeSender instead of
+// a live mail.Provider, so it doesn't need a database or real SMTP
+// server to prove the pipeline produces a sendable message.
+func TestRenderBuildSendPipeline(t *testing.T) {
+	tmplData := TemplateData{
+		Content: "<p>Hi {{.recipient.Name}}, your code is {{.params.code}}</p>",
+		Subject: "Your code",
+	}
+	recipient := Recipient{EmailAddress: "dest@example.com", Name: "Dana"}
+	parameters := map[string]interface{}{"code": "123456"}
+
+	html, plainText, err := renderTemplate(tmplData, recipient, parameters)
+	if err != nil {
+		t.Fatalf("renderTemplate: %v", err)
+	}
+	if !bytes.Contains([]byte(html), []byte("Hi Dana, your code is 123456")) {
+		t.Fatalf("rendered html missing substitutions: %s", html)
+	}
+	if plainText != "" {
+		t.Fatalf("expected no plain-text template to yield an empty string, got %q", plainText)
+	}
+
+	raw, err := mailbuilder.Build(mailbuilder.Params{
+		From:      "sender@example.com",
+		To:        recipient.EmailAddress,
+		Subject:   tmplData.Subject,
+		HTML:      html,
+		PlainText: plainText,
+		MessageID: "test-message-id@example.com",
+	})
+	if err != nil {
+		t.Fatalf("mailbuilder.Build: %v", err)
+	}
+
+	fake := &mail.FakeSender{}
+	if err := fake.Send(context.Background(), mail.Message{
+		From:    "sender@example.com",
+		To:      recipient.EmailAddress,
+		Subject: tmplData.Subject,
+		HTML:    html,
+		Raw:     raw,
+	}); err != nil {
+		t.Fatalf("fake.Send: %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 recorded send, got %d", len(calls))
+	}
+	sent := calls[0]
+	if sent.To != recipient.EmailAddress {
+		t.Errorf("To = %q, want %q", sent.To, recipient.EmailAddress)
+	}
+	if sent.Subject != tmplData.Subject {
+		t.Errorf("Subject = %q, want %q", sent.Subject, tmplData.Subject)
+	}
+	if len(sent.Raw) == 0 {
+		t.Errorf("expected non-empty raw MIME message")
+	}
+}
+
+// TestWithSMTPSenderSetsSender confirms WithSMTPSender actually wires a
+// FakeSender into the seam processJob sends through, rather than the
+// option silently being a no-op. processJob itself is not run here.
+func TestWithSMTPSenderSetsSender(t *testing.T) {
+	fake := &mail.FakeSender{}
+	ms := &MailService{}
+	WithSMTPSender(fake)(ms)
+
+	if ms.smtpSender != SMTPSender(fake) {
+		t.Fatalf("WithSMTPSender did not set smtpSender to the injected FakeSender")
+	}
+}